@@ -0,0 +1,36 @@
+// Copyright 2018 The CubeFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import "net/http"
+
+// adminSnapshotExportRoute/adminSnapshotImportRoute/adminMigrateBackendRoute
+// are the HTTP paths registerFsmAdminRoutes wires its handlers to.
+const (
+	adminSnapshotExportRoute = "/admin/snapshot/export"
+	adminSnapshotImportRoute = "/admin/snapshot/import"
+	adminMigrateBackendRoute = "/admin/fsm/migrateBackend"
+)
+
+// registerFsmAdminRoutes wires snapshotExportHandler, snapshotImportHandler,
+// and migrateBackendHandler into mux. Called by the master's main route
+// registration at startup, alongside its other /admin/... routes, so these
+// three handlers are actually reachable instead of only existing as
+// unregistered methods.
+func (m *Server) registerFsmAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc(adminSnapshotExportRoute, m.snapshotExportHandler)
+	mux.HandleFunc(adminSnapshotImportRoute, m.snapshotImportHandler)
+	mux.HandleFunc(adminMigrateBackendRoute, m.migrateBackendHandler)
+}
@@ -0,0 +1,131 @@
+// Copyright 2018 The CubeFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/cubefs/cubefs/util/log"
+)
+
+const (
+	fsmBackendRocksDB = "rocksdb"
+	fsmBackendBolt    = "bolt"
+)
+
+// FsmBackend is the storage abstraction MetadataFsm is driven through. It
+// exists so the master doesn't hard-depend on cgo/RocksDB: operators in a
+// constrained environment can run it against the pure-Go bolt backend
+// instead, at the cost of RocksDB's write throughput.
+type FsmBackend interface {
+	Get(key string) (interface{}, error)
+	BatchPut(data map[string][]byte, sync bool) error
+	DeleteKeyAndPutIndex(key string, cmdMap map[string][]byte, sync bool) error
+
+	// NewWriteBatch/WriteBatch let callers (e.g. snapshot restore) batch
+	// many mutations before a single underlying write.
+	NewWriteBatch() FsmWriteBatch
+	WriteBatch(batch FsmWriteBatch, sync bool) error
+
+	Snapshot() FsmSnapshotHandle
+	Iterator(snapshot FsmSnapshotHandle) FsmIterator
+
+	Open() error
+	Close()
+	Flush() error
+	GetDir() string
+
+	// OpenTemp opens a fresh backend of the same kind rooted at dir, used by
+	// ApplySnapshot/ImportSnapshot to stage a full replace before swapping
+	// it in.
+	OpenTemp(dir string) (FsmBackend, error)
+
+	// AtomicSwap replaces this backend's on-disk state with newBackend's,
+	// using whichever crash-safe technique fits this backend (rename for
+	// file-per-dir stores, file-copy for single-file stores), and leaves
+	// this backend open against the new state on success.
+	AtomicSwap(newBackend FsmBackend) error
+}
+
+// FsmWriteBatch is the subset of a backend's write-batch type MetadataFsm
+// relies on.
+type FsmWriteBatch interface {
+	Put(key, value []byte)
+	Clear()
+	Destroy()
+}
+
+// FsmIterator is the subset of a backend's iterator type MetadataFsm relies
+// on to walk a snapshot in key order.
+type FsmIterator interface {
+	SeekToFirst()
+	Seek(key []byte)
+	Valid() bool
+	Next()
+	Key() []byte
+	Value() []byte
+}
+
+// FsmSnapshotHandle is a consistent point-in-time read handle a backend can
+// hand out without blocking concurrent writes.
+type FsmSnapshotHandle interface {
+	Close()
+}
+
+// renameDirInto replaces liveDir with newDir via the rename-commit trick a
+// directory-rooted backend relies on for its commit point: move liveDir out
+// of the way into a throwaway temp directory, delete it, then rename newDir
+// into liveDir's place. Shared by rocksDBFsmBackend.AtomicSwap and
+// MetadataFsm.MigrateBackend, the two call sites that do this at the
+// directory level rather than through a single backend's own AtomicSwap.
+// On error, the caller is responsible for reopening whatever is left at
+// liveDir -- this function only ever moves directories, never reopens one.
+func renameDirInto(liveDir, newDir string) error {
+	removeDir, err := os.MkdirTemp("", "remove_by_rename")
+	if err != nil {
+		return err
+	}
+	removeDir = filepath.Join(removeDir, "remove")
+	if err = os.Rename(liveDir, removeDir); err != nil {
+		return err
+	}
+	if err = os.RemoveAll(removeDir); err != nil {
+		log.LogErrorf("action[renameDirInto] failed to remove directory %v, error %v", removeDir, err.Error())
+	}
+	return os.Rename(newDir, liveDir)
+}
+
+// fsmRecoveryDir returns the staging directory used to build a temp backend
+// before swapping it in, derived from the live backend's directory so it
+// lands next to it regardless of which backend is in use.
+func fsmRecoveryDir(liveDir string) string {
+	return liveDir + "_recovering"
+}
+
+// newFsmBackend opens the backend selected by the master's `fsmBackend`
+// config knob (defaults to rocksdb when kind is empty, for compatibility
+// with existing deployments).
+func newFsmBackend(kind, dir string, lruCacheSize, writeBufferSize int) (FsmBackend, error) {
+	switch kind {
+	case "", fsmBackendRocksDB:
+		return newRocksDBFsmBackend(dir, lruCacheSize, writeBufferSize)
+	case fsmBackendBolt:
+		return newBoltFsmBackend(dir)
+	default:
+		return nil, fmt.Errorf("unknown fsmBackend %q, expected %q or %q", kind, fsmBackendRocksDB, fsmBackendBolt)
+	}
+}
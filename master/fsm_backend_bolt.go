@@ -0,0 +1,145 @@
+// Copyright 2018 The CubeFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	boltstore "github.com/cubefs/cubefs/raftstore/raftstore_bolt"
+	"github.com/cubefs/cubefs/util/log"
+)
+
+// boltFsmBackend adapts *raftstore_bolt.BoltDBStore to the FsmBackend
+// interface.
+type boltFsmBackend struct {
+	store *boltstore.BoltDBStore
+}
+
+func newBoltFsmBackend(dir string) (FsmBackend, error) {
+	store, err := boltstore.NewBoltDBStore(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &boltFsmBackend{store: store}, nil
+}
+
+func (b *boltFsmBackend) Get(key string) (interface{}, error) {
+	return b.store.Get(key)
+}
+
+func (b *boltFsmBackend) BatchPut(data map[string][]byte, sync bool) error {
+	return b.store.BatchPut(data, sync)
+}
+
+func (b *boltFsmBackend) DeleteKeyAndPutIndex(key string, cmdMap map[string][]byte, sync bool) error {
+	return b.store.DeleteKeyAndPutIndex(key, cmdMap, sync)
+}
+
+func (b *boltFsmBackend) NewWriteBatch() FsmWriteBatch {
+	return b.store.NewWriteBatch()
+}
+
+func (b *boltFsmBackend) WriteBatch(batch FsmWriteBatch, sync bool) error {
+	wb, ok := batch.(*boltstore.WriteBatch)
+	if !ok {
+		return fmt.Errorf("bolt backend given a %T write batch, want *raftstore_bolt.WriteBatch", batch)
+	}
+	return b.store.WriteBatch(wb, sync)
+}
+
+func (b *boltFsmBackend) Snapshot() FsmSnapshotHandle {
+	snapshot, err := b.store.Snapshot()
+	if err != nil {
+		// FsmSnapshotHandle has no error return, matching the RocksDB
+		// backend's RocksDBSnapshot(); a failure here means the bolt file
+		// itself is unusable, so the caller will fail on the first read.
+		log.LogErrorf("action[boltFsmBackend.Snapshot] failed to open snapshot, err %v", err)
+		return &boltstore.Snapshot{}
+	}
+	return snapshot
+}
+
+func (b *boltFsmBackend) Iterator(snapshot FsmSnapshotHandle) FsmIterator {
+	sn, ok := snapshot.(*boltstore.Snapshot)
+	if !ok {
+		panic(fmt.Sprintf("bolt backend given a %T snapshot, want *raftstore_bolt.Snapshot", snapshot))
+	}
+	return b.store.Iterator(sn)
+}
+
+func (b *boltFsmBackend) Open() error {
+	return b.store.Open()
+}
+
+func (b *boltFsmBackend) Close() {
+	b.store.Close()
+}
+
+func (b *boltFsmBackend) Flush() error {
+	return b.store.Flush()
+}
+
+func (b *boltFsmBackend) GetDir() string {
+	return b.store.GetDir()
+}
+
+func (b *boltFsmBackend) OpenTemp(dir string) (FsmBackend, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	return newBoltFsmBackend(dir)
+}
+
+// AtomicSwap replaces this store's single bolt file with newBackend's via
+// file copy + rename: unlike RocksDB's directory-per-store layout, a bolt
+// store is one file, so there's nothing to rename at the directory level.
+func (b *boltFsmBackend) AtomicSwap(newBackend FsmBackend) error {
+	nb, ok := newBackend.(*boltFsmBackend)
+	if !ok {
+		return fmt.Errorf("cannot atomic-swap bolt backend with a %T backend", newBackend)
+	}
+	nb.store.Close()
+	b.store.Close()
+
+	swapPath := b.store.DBPath() + ".swap"
+	if err := copyFile(nb.store.DBPath(), swapPath); err != nil {
+		b.store.Open()
+		return err
+	}
+	if err := os.Rename(swapPath, b.store.DBPath()); err != nil {
+		b.store.Open()
+		return err
+	}
+	return b.store.Open()
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
@@ -0,0 +1,123 @@
+// Copyright 2018 The CubeFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"os"
+
+	raftstore "github.com/cubefs/cubefs/raftstore/raftstore_db"
+	"github.com/cubefs/cubefs/util/log"
+	"github.com/tecbot/gorocksdb"
+)
+
+// rocksDBFsmBackend adapts *raftstore_db.RocksDBStore to the FsmBackend
+// interface.
+type rocksDBFsmBackend struct {
+	store *raftstore.RocksDBStore
+}
+
+func newRocksDBFsmBackend(dir string, lruCacheSize, writeBufferSize int) (FsmBackend, error) {
+	store, err := raftstore.NewRocksDBStore(dir, lruCacheSize, writeBufferSize)
+	if err != nil {
+		return nil, err
+	}
+	return &rocksDBFsmBackend{store: store}, nil
+}
+
+func (b *rocksDBFsmBackend) Get(key string) (interface{}, error) {
+	return b.store.Get(key)
+}
+
+func (b *rocksDBFsmBackend) BatchPut(data map[string][]byte, sync bool) error {
+	return b.store.BatchPut(data, sync)
+}
+
+func (b *rocksDBFsmBackend) DeleteKeyAndPutIndex(key string, cmdMap map[string][]byte, sync bool) error {
+	return b.store.DeleteKeyAndPutIndex(key, cmdMap, sync)
+}
+
+func (b *rocksDBFsmBackend) NewWriteBatch() FsmWriteBatch {
+	return gorocksdb.NewWriteBatch()
+}
+
+func (b *rocksDBFsmBackend) WriteBatch(batch FsmWriteBatch, sync bool) error {
+	wb, ok := batch.(*gorocksdb.WriteBatch)
+	if !ok {
+		return fmt.Errorf("rocksdb backend given a %T write batch, want *gorocksdb.WriteBatch", batch)
+	}
+	return b.store.WriteBatch(wb, sync)
+}
+
+func (b *rocksDBFsmBackend) Snapshot() FsmSnapshotHandle {
+	return b.store.RocksDBSnapshot()
+}
+
+func (b *rocksDBFsmBackend) Iterator(snapshot FsmSnapshotHandle) FsmIterator {
+	s, ok := snapshot.(*raftstore.Snapshot)
+	if !ok {
+		panic(fmt.Sprintf("rocksdb backend given a %T snapshot, want *raftstore_db.Snapshot", snapshot))
+	}
+	return b.store.Iterator(s)
+}
+
+func (b *rocksDBFsmBackend) Open() error {
+	return b.store.Open()
+}
+
+func (b *rocksDBFsmBackend) Close() {
+	b.store.Close()
+}
+
+func (b *rocksDBFsmBackend) Flush() error {
+	return b.store.Flush()
+}
+
+func (b *rocksDBFsmBackend) GetDir() string {
+	return b.store.GetDir()
+}
+
+func (b *rocksDBFsmBackend) OpenTemp(dir string) (FsmBackend, error) {
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	return newRocksDBFsmBackend(dir, b.store.GetLruCacheSize(), b.store.GetWriteBufferSize())
+}
+
+// AtomicSwap replaces this store's directory with newBackend's via the
+// rename-commit trick: close both, rename the live dir out of the way,
+// rename the new dir into place, then reopen. A crash between the two
+// renames leaves neither directory at the live path, which is why the
+// caller only reaches this point after the new backend has been fully
+// written and flushed.
+func (b *rocksDBFsmBackend) AtomicSwap(newBackend FsmBackend) error {
+	nb, ok := newBackend.(*rocksDBFsmBackend)
+	if !ok {
+		return fmt.Errorf("cannot atomic-swap rocksdb backend with a %T backend", newBackend)
+	}
+	nb.store.Close()
+	b.store.Close()
+	if err := renameDirInto(b.store.GetDir(), nb.store.GetDir()); err != nil {
+		// Whatever step failed, b.store was already closed above -- reopen
+		// it against whatever is now at its directory (the original state,
+		// or an empty one if the old directory was already moved away)
+		// rather than leaving the live fsm stuck with a closed handle.
+		if openErr := b.store.Open(); openErr != nil {
+			log.LogErrorf("action[rocksDBFsmBackend.AtomicSwap] failed to reopen store after a failed swap, error %v", openErr.Error())
+		}
+		return err
+	}
+	return b.store.Open()
+}
@@ -0,0 +1,133 @@
+// Copyright 2018 The CubeFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cubefs/cubefs/util/log"
+)
+
+// raftFsmFatalHandler is invoked by MetadataFsm.fatal once raft has been
+// stopped and the poisoned marker persisted, so the master can react --
+// e.g. step down as leader -- before the process finally panics.
+type raftFsmFatalHandler func(err error)
+
+// poisonedMarkerFile is written next to the store directory by fatal, and
+// checked by IsPoisoned at startup so a node that hit an unrecoverable
+// error doesn't silently rejoin quorum before an operator has looked at it.
+const poisonedMarkerFile = ".poisoned"
+
+// fatalDrainTimeout bounds how long fatal waits for in-flight admin HTTP
+// requests to finish on their own before giving up and panicking anyway.
+const fatalDrainTimeout = 5 * time.Second
+
+// registerRaftFsmFatalHandler wires the handler MetadataFsm.fatal invokes
+// after it has stopped raft and persisted the poisoned marker.
+func (mf *MetadataFsm) registerRaftFsmFatalHandler(handler raftFsmFatalHandler) {
+	mf.fatalHandler = handler
+}
+
+// fatal is the single path every unrecoverable MetadataFsm error goes
+// through instead of calling panic directly. It logs a structured record of
+// what failed, stops raft so no further entries are applied, persists a
+// marker so this node refuses to rejoin quorum on restart, drains in-flight
+// admin HTTP requests, invokes the registered raftFsmFatalHandler, and only
+// then re-panics -- mirroring what the direct panic(err) call sites used to
+// do, but with the chance for the rest of the process to shut down cleanly
+// first.
+func (mf *MetadataFsm) fatal(op uint32, key string, index uint64, cause error) {
+	log.LogCriticalf("action[MetadataFsm.fatal] unrecoverable error,op[%v],key[%v],index[%v],applied[%v],err[%v]",
+		op, key, index, mf.applied, cause)
+
+	mf.Stop()
+
+	if markErr := mf.persistPoisonedMarker(cause); markErr != nil {
+		log.LogErrorf("action[MetadataFsm.fatal] failed to persist poisoned marker,err[%v]", markErr)
+	}
+
+	fsmAdminGate.poison(fatalDrainTimeout)
+
+	if mf.fatalHandler != nil {
+		mf.fatalHandler(cause)
+	}
+
+	panic(cause)
+}
+
+// persistPoisonedMarker writes a sentinel file recording why this node went
+// fatal, so a restart can detect it via IsPoisoned and refuse to rejoin
+// quorum until an operator has cleared it.
+func (mf *MetadataFsm) persistPoisonedMarker(cause error) error {
+	path := filepath.Join(mf.store.GetDir(), poisonedMarkerFile)
+	content := fmt.Sprintf("applied=%v err=%v\n", mf.applied, cause)
+	return os.WriteFile(path, []byte(content), 0o644)
+}
+
+// IsPoisoned reports whether dir carries a poisoned marker left behind by a
+// prior fatal error, so master startup can refuse to let this node rejoin
+// quorum before an operator has cleared it.
+func IsPoisoned(dir string) bool {
+	_, err := os.Stat(filepath.Join(dir, poisonedMarkerFile))
+	return err == nil
+}
+
+// fsmAdminGate tracks in-flight admin HTTP requests so MetadataFsm.fatal can
+// let them drain before the process goes down, while immediately rejecting
+// anything that arrives after the node is marked poisoned.
+var fsmAdminGate = &adminRequestGate{}
+
+var errFsmPoisoned = fmt.Errorf("master is handling a fatal raft error and is no longer accepting admin requests")
+
+type adminRequestGate struct {
+	poisoned int32
+	inflight sync.WaitGroup
+}
+
+// enter must be called at the top of every admin HTTP handler that touches
+// the fsm; it returns errFsmPoisoned once the node has gone fatal, and
+// otherwise registers the caller as in-flight until it calls leave.
+func (g *adminRequestGate) enter() error {
+	if atomic.LoadInt32(&g.poisoned) != 0 {
+		return errFsmPoisoned
+	}
+	g.inflight.Add(1)
+	return nil
+}
+
+func (g *adminRequestGate) leave() {
+	g.inflight.Done()
+}
+
+// poison rejects all future admin requests immediately and waits up to
+// drainTimeout for requests already in flight to finish on their own.
+func (g *adminRequestGate) poison(drainTimeout time.Duration) {
+	atomic.StoreInt32(&g.poisoned, 1)
+	done := make(chan struct{})
+	go func() {
+		g.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		log.LogWarnf("action[adminRequestGate.poison] timed out waiting for in-flight admin requests to drain")
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2018 The CubeFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/cubefs/cubefs/util/log"
+)
+
+// MigrateFsmBackend copies every key in src to dst through the same batched
+// WriteBatch path ApplySnapshot uses, so an operator can move a master's
+// state directory between backends (e.g. rocksdb -> bolt) with a single
+// offline pass. Both src and dst must already be open; dst is flushed but
+// left open so the caller can AtomicSwap or Close it as appropriate.
+func MigrateFsmBackend(src, dst FsmBackend, batchBytes uint64, batchCount int) (migrated uint64, err error) {
+	snapshot := src.Snapshot()
+	defer snapshot.Close()
+	iterator := src.Iterator(snapshot)
+
+	batch := dst.NewWriteBatch()
+	defer batch.Destroy()
+	var pendingBytes uint64
+	var pendingCount int
+
+	flush := func() error {
+		if pendingCount == 0 {
+			return nil
+		}
+		if err := dst.WriteBatch(batch, false); err != nil {
+			return err
+		}
+		batch.Clear()
+		pendingBytes, pendingCount = 0, 0
+		return nil
+	}
+
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		key, value := iterator.Key(), iterator.Value()
+		batch.Put(key, value)
+		pendingBytes += uint64(len(key) + len(value))
+		pendingCount++
+		migrated++
+		if pendingBytes >= batchBytes || pendingCount >= batchCount {
+			if err = flush(); err != nil {
+				return migrated, err
+			}
+		}
+	}
+	if err = flush(); err != nil {
+		return migrated, err
+	}
+	if err = dst.Flush(); err != nil {
+		return migrated, err
+	}
+	log.LogWarnf("action[MigrateFsmBackend] migrated %v keys", migrated)
+	return migrated, nil
+}
+
+// MigrateBackend is the online entry point for MigrateFsmBackend: it builds a
+// fresh backend of kind toKind next to the live store and copies every key
+// across. Like ImportSnapshot, it bypasses raft entirely, so it's only safe
+// to run on a stopped or single-node master.
+//
+// It can't reuse FsmBackend.AtomicSwap for the final commit, since that
+// trick is specific to swapping a backend with another of the same concrete
+// type (rename for RocksDB's directory-per-store layout, file-copy for
+// bolt's single file). Migrating between kinds instead does the same
+// rename-commit dance directly on the directory both backends are rooted
+// at, then opens a fresh toKind backend against the live path.
+func (mf *MetadataFsm) MigrateBackend(toKind string) (migrated uint64, err error) {
+	if !mf.importSafe() {
+		return 0, fmt.Errorf("action[MigrateBackend] refusing to migrate: master is neither stopped nor single-node")
+	}
+
+	liveDir := mf.store.GetDir()
+	migDir := fsmRecoveryDir(liveDir)
+	if err = os.RemoveAll(migDir); err != nil {
+		return 0, err
+	}
+	dst, err := newFsmBackend(toKind, migDir, 0, 0)
+	if err != nil {
+		return 0, err
+	}
+	if migrated, err = MigrateFsmBackend(mf.store, dst, mf.snapshotRestoreBatchBytes, mf.snapshotRestoreBatchCount); err != nil {
+		dst.Close()
+		return migrated, err
+	}
+	dst.Close()
+
+	// commit point: same renameDirInto trick rocksDBFsmBackend.AtomicSwap
+	// uses, done one level up since the two directories hold different
+	// backend kinds.
+	mf.store.Close()
+	if err = renameDirInto(liveDir, migDir); err != nil {
+		// liveDir still holds the original backend's data (or, if the
+		// rename-out step already ran, an empty directory) -- either way
+		// mf.store's own Open reopens it against the original kind rather
+		// than leaving the fsm stuck with a closed handle.
+		if openErr := mf.store.Open(); openErr != nil {
+			log.LogErrorf("action[MigrateBackend] failed to reopen original backend after a failed swap, error %v", openErr.Error())
+		}
+		return migrated, err
+	}
+	// The rename succeeded, so liveDir now holds toKind's data -- mf.store
+	// is the old backend object and can no longer open it, so a fresh
+	// toKind backend is what reopens it.
+	newStore, err := newFsmBackend(toKind, liveDir, 0, 0)
+	if err != nil {
+		log.LogErrorf("action[MigrateBackend] swap committed but failed to reopen the new %v backend, error %v", toKind, err.Error())
+		return migrated, err
+	}
+	mf.store = newStore
+	log.LogWarnf("action[MigrateBackend] success,toKind[%v],migrated[%v]", toKind, migrated)
+	return migrated, nil
+}
+
+// migrateBackendHandler implements POST /admin/fsm/migrateBackend?toKind=.
+// See MetadataFsm.MigrateBackend for the copy-and-commit behavior.
+func (m *Server) migrateBackendHandler(w http.ResponseWriter, r *http.Request) {
+	release, ok := withAdminGate(w)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if err := r.ParseForm(); err != nil {
+		sendErrReply(w, r, newErrHTTPReply(err))
+		return
+	}
+	toKind := r.FormValue("toKind")
+	migrated, err := m.cluster.fsm.MigrateBackend(toKind)
+	if err != nil {
+		sendErrReply(w, r, newErrHTTPReply(err))
+		return
+	}
+	sendOkReply(w, r, newSuccessHTTPReply(fmt.Sprintf("migrated %v keys to %v backend", migrated, toKind)))
+}
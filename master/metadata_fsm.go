@@ -15,22 +15,40 @@
 package master
 
 import (
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"hash/crc64"
 	"io"
-	"os"
 	"strconv"
+	"sync/atomic"
 
 	"github.com/cubefs/cubefs/depends/tiglabs/raft"
 	"github.com/cubefs/cubefs/depends/tiglabs/raft/proto"
-	raftstore "github.com/cubefs/cubefs/raftstore/raftstore_db"
-	"github.com/cubefs/cubefs/util/fileutil"
+	"github.com/cubefs/cubefs/util/config"
 	"github.com/cubefs/cubefs/util/log"
 	"github.com/cubefs/cubefs/util/stat"
 )
 
 const (
 	applied = "applied"
+
+	// defaultSnapshotRestoreBatchBytes/defaultSnapshotRestoreBatchCount bound
+	// the size of the backend WriteBatch accumulated while replaying a
+	// snapshot, so a single flush never grows unbounded for a huge master
+	// state.
+	defaultSnapshotRestoreBatchBytes = 64 * 1024 * 1024
+	defaultSnapshotRestoreBatchCount = 16000
+
+	// cfgKeySnapshotRestoreBatchBytes/cfgKeySnapshotRestoreBatchCount are the
+	// master config keys LoadSnapshotRestoreBatchConfig reads.
+	cfgKeySnapshotRestoreBatchBytes = "snapshotRestoreBatchBytes"
+	cfgKeySnapshotRestoreBatchCount = "snapshotRestoreBatchCount"
+
+	// cfgKeyFsmBackend is the master config key NewMetadataFsm reads to pick
+	// the storage engine (fsmBackendRocksDB or fsmBackendBolt) the fsm's
+	// store is constructed from; see newFsmBackend.
+	cfgKeyFsmBackend = "fsmBackend"
 )
 
 type raftLeaderChangeHandler func(leader uint64)
@@ -43,7 +61,7 @@ type raftApplySnapshotHandler func()
 
 // MetadataFsm represents the finite state machine of a metadata partition
 type MetadataFsm struct {
-	store               *raftstore.RocksDBStore
+	store               FsmBackend
 	rs                  *raft.RaftServer
 	applied             uint64
 	retainLogs          uint64
@@ -52,16 +70,95 @@ type MetadataFsm struct {
 	snapshotHandler     raftApplySnapshotHandler
 	UserAppCmdHandler   raftUserCmdApplyHandler
 	onSnapshot          bool
+
+	// snapshotRestoreBatchBytes/snapshotRestoreBatchCount are the flush
+	// thresholds used while replaying ApplySnapshot; configurable from the
+	// master config so operators can tune memory vs. write amplification.
+	snapshotRestoreBatchBytes uint64
+	snapshotRestoreBatchCount int
+
+	// fatalHandler is invoked by fatal once raft has been stopped and the
+	// poisoned marker persisted. See registerRaftFsmFatalHandler.
+	fatalHandler raftFsmFatalHandler
+
+	// stopped is set by Stop, and singleNode is set by SetSingleNode at
+	// startup for a genuinely single-member cluster. importSafe reports true
+	// once either holds, since ImportSnapshot bypasses raft and would desync
+	// replicas if run against a live multi-node cluster.
+	stopped    int32
+	singleNode bool
 }
 
-func newMetadataFsm(store *raftstore.RocksDBStore, retainsLog uint64, rs *raft.RaftServer) (fsm *MetadataFsm) {
+func newMetadataFsm(store FsmBackend, retainsLog uint64, rs *raft.RaftServer) (fsm *MetadataFsm) {
 	fsm = new(MetadataFsm)
 	fsm.store = store
 	fsm.rs = rs
 	fsm.retainLogs = retainsLog
+	fsm.snapshotRestoreBatchBytes = defaultSnapshotRestoreBatchBytes
+	fsm.snapshotRestoreBatchCount = defaultSnapshotRestoreBatchCount
 	return
 }
 
+// NewMetadataFsm is what master startup constructs its MetadataFsm through:
+// it opens dir with the storage engine selected by the cfgKeyFsmBackend
+// config knob (rocksdb|bolt, defaulting to rocksdb via newFsmBackend) and
+// wraps it in a MetadataFsm, then loads the rest of the fsm's config-driven
+// and startup-driven knobs, so they actually reach a running master instead
+// of sitting unread: the restore-batch thresholds come from the same cfg,
+// singleNode records whether rs's peer list has exactly one member (so
+// ImportSnapshot/MigrateBackend can run against a live single-node
+// cluster), and fatalHandler is what fatal invokes after it has stopped
+// raft and persisted the poisoned marker -- wire it to the master's own
+// leader-step-down logic.
+func NewMetadataFsm(cfg *config.Config, dir string, retainsLog uint64, rs *raft.RaftServer, singleNode bool, fatalHandler raftFsmFatalHandler) (fsm *MetadataFsm, err error) {
+	store, err := newFsmBackend(cfg.GetString(cfgKeyFsmBackend), dir, 0, 0)
+	if err != nil {
+		return nil, err
+	}
+	fsm = newMetadataFsm(store, retainsLog, rs)
+	fsm.LoadSnapshotRestoreBatchConfig(cfg)
+	fsm.SetSingleNode(singleNode)
+	fsm.registerRaftFsmFatalHandler(fatalHandler)
+	return fsm, nil
+}
+
+// SetSnapshotRestoreBatchConfig overrides the default batch-flush thresholds
+// used while replaying a snapshot. A zero value keeps the default.
+func (mf *MetadataFsm) SetSnapshotRestoreBatchConfig(batchBytes uint64, batchCount int) {
+	if batchBytes > 0 {
+		mf.snapshotRestoreBatchBytes = batchBytes
+	}
+	if batchCount > 0 {
+		mf.snapshotRestoreBatchCount = batchCount
+	}
+}
+
+// LoadSnapshotRestoreBatchConfig reads cfgKeySnapshotRestoreBatchBytes/
+// cfgKeySnapshotRestoreBatchCount from the master config and applies them via
+// SetSnapshotRestoreBatchConfig. Called once at startup, right after the fsm
+// is constructed, so the snapshotRestoreBatchBytes/snapshotRestoreBatchCount
+// config knobs actually reach the running fsm instead of sitting unread.
+func (mf *MetadataFsm) LoadSnapshotRestoreBatchConfig(cfg *config.Config) {
+	batchBytes := cfg.GetInt64(cfgKeySnapshotRestoreBatchBytes)
+	batchCount := cfg.GetInt64(cfgKeySnapshotRestoreBatchCount)
+	mf.SetSnapshotRestoreBatchConfig(uint64(batchBytes), int(batchCount))
+}
+
+// SetSingleNode records whether this master is the sole member of its raft
+// group, so ImportSnapshot/MigrateBackend can allow running against a live
+// single-node cluster instead of only a fully-stopped one. Called once at
+// startup from the peer list the master was configured with.
+func (mf *MetadataFsm) SetSingleNode(singleNode bool) {
+	mf.singleNode = singleNode
+}
+
+// importSafe reports whether it's safe to bypass raft and directly replace
+// the store's contents: either this fsm has been stopped, or it was started
+// as a genuinely single-node cluster, so there are no peers to desync.
+func (mf *MetadataFsm) importSafe() bool {
+	return atomic.LoadInt32(&mf.stopped) != 0 || mf.singleNode
+}
+
 // Corresponding to the LeaderChange interface in Raft library.
 func (mf *MetadataFsm) registerLeaderChangeHandler(handler raftLeaderChangeHandler) {
 	mf.leaderChangeHandler = handler
@@ -90,26 +187,35 @@ func (mf *MetadataFsm) restoreApplied() {
 
 	value, err := mf.store.Get(applied)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to restore applied err:%v", err.Error()))
+		mf.fatal(0, applied, mf.applied, err)
 	}
 	byteValues := value.([]byte)
 	if len(byteValues) == 0 {
 		mf.applied = 0
 		return
 	}
-	applied, err := strconv.ParseUint(string(byteValues), 10, 64)
+	appliedIndex, err := strconv.ParseUint(string(byteValues), 10, 64)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to restore applied,err:%v ", err.Error()))
+		mf.fatal(0, applied, mf.applied, err)
 	}
-	mf.applied = applied
+	mf.applied = appliedIndex
 }
 
 // Apply implements the interface of raft.StateMachine
 func (mf *MetadataFsm) Apply(command []byte, index uint64) (resp interface{}, err error) {
+	// Guard against the raft library redelivering an already-committed
+	// entry (e.g. around a leader change or recovery from a crash mid-batch).
+	// Re-executing a delete/put here could corrupt derived in-memory state
+	// that handlers rebuild from the cmd stream, so skip it outright.
+	if mf.applied != 0 && index <= mf.applied {
+		log.LogWarnf("action[fsmApply] skipping already-applied entry,index[%v],applied[%v]", index, mf.applied)
+		return nil, nil
+	}
+
 	cmd := new(RaftCmd)
 	if err = cmd.Unmarshal(command); err != nil {
 		log.LogErrorf("action[fsmApply],unmarshal data:%v, err:%v", command, err.Error())
-		panic(err)
+		mf.fatal(0, "", index, err)
 	}
 
 	cmdMap := make(map[string][]byte)
@@ -120,7 +226,7 @@ func (mf *MetadataFsm) Apply(command []byte, index uint64) (resp interface{}, er
 		nestedCmdMap := make(map[string]*RaftCmd)
 		if err = json.Unmarshal(cmd.V, &nestedCmdMap); err != nil {
 			log.LogErrorf("action[fsmApply],unmarshal nested cmd data:%v, err:%v", command, err.Error())
-			panic(err)
+			mf.fatal(cmd.Op, cmd.K, index, err)
 		}
 		for cmdK, cmd := range nestedCmdMap {
 			cmdMap[cmdK] = cmd.V
@@ -132,7 +238,7 @@ func (mf *MetadataFsm) Apply(command []byte, index uint64) (resp interface{}, er
 	case opSyncDeleteDataNode, opSyncDeleteMetaNode, opSyncDeleteVol, opSyncDeleteDataPartition, opSyncDeleteMetaPartition,
 		opSyncDeleteUserInfo, opSyncDeleteAKUser, opSyncDeleteVolUser, opSyncDeleteQuota, opSyncDeleteLcNode, opSyncDeleteLcConf, opSyncS3QosDelete:
 		if err = mf.delKeyAndPutIndex(cmd.K, cmdMap); err != nil {
-			panic(err)
+			mf.fatal(cmd.Op, cmd.K, index, err)
 		}
 	case opSyncPutFollowerApiLimiterInfo, opSyncPutApiLimiterInfo:
 		mf.UserAppCmdHandler(cmd.Op, cmd.K, cmdMap)
@@ -140,12 +246,12 @@ func (mf *MetadataFsm) Apply(command []byte, index uint64) (resp interface{}, er
 		//	panic(err)
 		//}
 		if err = mf.store.BatchPut(cmdMap, true); err != nil {
-			panic(err)
+			mf.fatal(cmd.Op, cmd.K, index, err)
 		}
 	default:
 		// sync put data
 		if err = mf.store.BatchPut(cmdMap, true); err != nil {
-			panic(err)
+			mf.fatal(cmd.Op, cmd.K, index, err)
 		}
 	}
 
@@ -169,7 +275,7 @@ func (mf *MetadataFsm) ApplyMemberChange(confChange *proto.ConfChange, index uin
 
 // Snapshot implements the interface of raft.StateMachine
 func (mf *MetadataFsm) Snapshot() (proto.Snapshot, error) {
-	snapshot := mf.store.RocksDBSnapshot()
+	snapshot := mf.store.Snapshot()
 	iterator := mf.store.Iterator(snapshot)
 	iterator.SeekToFirst()
 	return &MetadataSnapshot{
@@ -180,102 +286,160 @@ func (mf *MetadataFsm) Snapshot() (proto.Snapshot, error) {
 	}, nil
 }
 
-// ApplySnapshot implements the interface of raft.StateMachine
+// ApplySnapshot implements the interface of raft.StateMachine. It stages the
+// incoming snapshot into a fresh temp backend, verifying the CRC-framed
+// records and trailing checksum as it goes, then swaps it in via
+// FsmBackend.AtomicSwap -- the backend's own rename/copy commit-point
+// primitive. A failure before the swap leaves the live store untouched; what a
+// failure inside AtomicSwap leaves behind depends on the backend.
 func (mf *MetadataFsm) ApplySnapshot(peers []proto.Peer, iterator proto.SnapIterator) (err error) {
-	log.LogWarnf("action[ApplySnapshot] reset rocksdb before applying snapshot")
+	log.LogWarnf("action[ApplySnapshot] reset store before applying snapshot")
 	mf.onSnapshot = true
 	defer func() {
 		mf.onSnapshot = false
 	}()
-	var data []byte
-	// clear recovery dir
-	recoveryDir := raftstore.GetRocksDBStoreRecoveryDir(mf.store.GetDir())
-	if fileutil.ExistDir(recoveryDir) {
-		if err = os.RemoveAll(recoveryDir); err != nil {
-			log.LogErrorf("failed to remove temp dir %v, error %v", recoveryDir, err.Error())
-			return
-		}
-	}
-	rocksdbOpened := true
-	removeDir := ""
-	// open temp rocksdb
-	tempDb, err := raftstore.NewRocksDBStore(recoveryDir, mf.store.GetLruCacheSize(), mf.store.GetWriteBufferSize())
-	if err != nil {
-		log.LogErrorf("failed to open temp rocksdb %v", err.Error())
-		goto errHandler
-	}
-	// close rocksdb
-	mf.store.Close()
-	rocksdbOpened = false
-	// remove by rename
-	removeDir, err = os.MkdirTemp("", "remove_by_rename")
+
+	tempDb, err := mf.store.OpenTemp(fsmRecoveryDir(mf.store.GetDir()))
 	if err != nil {
-		log.LogErrorf("failed to get temp dir %v", err.Error())
-		goto errHandler
+		log.LogErrorf("action[ApplySnapshot] failed to open temp backend %v", err.Error())
+		return err
 	}
-	removeDir = fmt.Sprintf("%s/remove", removeDir)
+
 	log.LogWarnf(fmt.Sprintf("action[ApplySnapshot] begin,applied[%v]", mf.applied))
-	for err == nil {
+	var (
+		data           []byte
+		streamOffset   int64
+		entryCount     uint64
+		runningCRC     uint64
+		trailerSeen    bool
+		batchBytes     uint64
+		batchCount     int
+		flushedBatches int
+		flushedBytes   uint64
+	)
+	batch := tempDb.NewWriteBatch()
+	defer batch.Destroy()
+
+	// first record on the wire is a bare snapshotFormatVersion byte, ahead of
+	// any framed/CRC-checked records, so a format mismatch is caught here
+	// instead of failing deep inside a JSON unmarshal.
+	if data, err = iterator.Next(); err != nil {
+		tempDb.Close()
+		log.LogError(fmt.Sprintf("action[ApplySnapshot] failed,err:%v", err.Error()))
+		return err
+	}
+	if len(data) != 1 || data[0] != snapshotFormatVersion {
+		tempDb.Close()
+		err = fmt.Errorf("action[ApplySnapshot] unsupported snapshot format version, got %v", data)
+		log.LogError(err.Error())
+		return err
+	}
+	streamOffset += int64(len(data))
+
+	for {
 		bgTime := stat.BeginStat()
 		if data, err = iterator.Next(); err != nil {
 			break
 		}
-		stat.EndStat("ApplySnapshot-Next", err, bgTime, 1)
-		cmd := &RaftCmd{}
-		if err = json.Unmarshal(data, cmd); err != nil {
+		stat.EndStat("ApplySnapshot-Next", nil, bgTime, 1)
+
+		var payload []byte
+		if payload, err = decodeSnapshotFrame(data); err != nil {
 			tempDb.Close()
-			goto errHandler
+			err = fmt.Errorf("action[ApplySnapshot] corrupt record at stream offset %v: %v", streamOffset, err)
+			log.LogError(err.Error())
+			return err
 		}
-		bgTime = stat.BeginStat()
-		if _, err = tempDb.Put(cmd.K, cmd.V, false); err != nil {
+		streamOffset += int64(len(data))
+
+		cmd := &RaftCmd{}
+		if err = json.Unmarshal(payload, cmd); err != nil {
 			tempDb.Close()
-			goto errHandler
+			log.LogError(fmt.Sprintf("action[ApplySnapshot] failed,err:%v", err.Error()))
+			return err
+		}
+		if cmd.Op == opSnapshotTrailer {
+			trailerSeen = true
+			wantCRC := binary.BigEndian.Uint64(cmd.V)
+			gotCRC := crc64.Update(runningCRC, snapshotCRCTable, uint64ToBytes(entryCount))
+			if gotCRC != wantCRC {
+				tempDb.Close()
+				err = fmt.Errorf("action[ApplySnapshot] trailing checksum mismatch at stream offset %v: want %x got %x", streamOffset, wantCRC, gotCRC)
+				log.LogError(err.Error())
+				return err
+			}
+			continue
+		}
+
+		runningCRC = crc64.Update(runningCRC, snapshotCRCTable, payload)
+		entryCount++
+		batch.Put([]byte(cmd.K), cmd.V)
+		batchBytes += uint64(len(cmd.K) + len(cmd.V))
+		batchCount++
+		if batchBytes >= mf.snapshotRestoreBatchBytes || batchCount >= mf.snapshotRestoreBatchCount {
+			bgTime = stat.BeginStat()
+			if err = tempDb.WriteBatch(batch, false); err != nil {
+				tempDb.Close()
+				log.LogError(fmt.Sprintf("action[ApplySnapshot] failed,err:%v", err.Error()))
+				return err
+			}
+			stat.EndStat("ApplySnapshot-WriteBatch", nil, bgTime, 1)
+			stat.EndStat("ApplySnapshot-BatchesFlushed", nil, bgTime, 1)
+			stat.EndStat("ApplySnapshot-BytesWritten", nil, bgTime, int(batchBytes))
+			flushedBatches++
+			flushedBytes += batchBytes
+			batch.Clear()
+			batchBytes, batchCount = 0, 0
 		}
-		stat.EndStat("ApplySnapshot-Put", err, bgTime, 1)
 	}
-	if err != nil && err != io.EOF {
+	if err != io.EOF {
 		tempDb.Close()
-		goto errHandler
+		log.LogError(fmt.Sprintf("action[ApplySnapshot] failed,err:%v", err.Error()))
+		return err
 	}
+	if !trailerSeen {
+		tempDb.Close()
+		err = fmt.Errorf("action[ApplySnapshot] snapshot stream ended before trailer record, %v entries seen", entryCount)
+		log.LogError(err.Error())
+		return err
+	}
+
+	if batchCount > 0 {
+		bgTime := stat.BeginStat()
+		if err = tempDb.WriteBatch(batch, false); err != nil {
+			tempDb.Close()
+			log.LogError(fmt.Sprintf("action[ApplySnapshot] failed,err:%v", err.Error()))
+			return err
+		}
+		stat.EndStat("ApplySnapshot-WriteBatch", nil, bgTime, 1)
+		stat.EndStat("ApplySnapshot-BatchesFlushed", nil, bgTime, 1)
+		stat.EndStat("ApplySnapshot-BytesWritten", nil, bgTime, int(batchBytes))
+		flushedBatches++
+		flushedBytes += batchBytes
+	}
+	log.LogWarnf("action[ApplySnapshot] restore batching done, batchesFlushed[%v] bytesWritten[%v]", flushedBatches, flushedBytes)
 
 	if err = tempDb.Flush(); err != nil {
 		log.LogError(fmt.Sprintf("action[ApplySnapshot] Flush failed,err:%v", err.Error()))
 		tempDb.Close()
-		goto errHandler
-	}
-	tempDb.Close()
-	// commit point, remove by rename
-	if err = os.Rename(mf.store.GetDir(), removeDir); err != nil {
-		goto errHandler
-	}
-	if err = os.RemoveAll(removeDir); err != nil {
-		err = nil
-		log.LogErrorf("failed to remove directory %v", err.Error())
-	}
-	// rename new dir to raft store dir
-	if err = os.Rename(tempDb.GetDir(), mf.store.GetDir()); err != nil {
-		goto errHandler
+		return err
 	}
-	// finish snapshot
-	err = mf.store.Open()
-	if err != nil {
-		log.LogErrorf("failed to open rocksdb %v", err.Error())
+	// commit point: atomically replace the live backend's state with tempDb's.
+	if err = mf.store.AtomicSwap(tempDb); err != nil {
+		log.LogError(fmt.Sprintf("action[ApplySnapshot] AtomicSwap failed,err:%v", err.Error()))
 		return err
 	}
 	mf.snapshotHandler()
 	log.LogWarnf(fmt.Sprintf("action[ApplySnapshot] success,applied[%v]", mf.applied))
 	return nil
-errHandler:
-	if !rocksdbOpened {
-		mf.store.Open()
-	}
-	log.LogError(fmt.Sprintf("action[ApplySnapshot] failed,err:%v", err.Error()))
-	return err
 }
 
-// HandleFatalEvent implements the interface of raft.StateMachine
+// HandleFatalEvent implements the interface of raft.StateMachine. It routes
+// through the same fatal path Apply/restoreApplied use, so a fatal error
+// reported by the raft library itself gets the same stop/persist/drain
+// treatment as one MetadataFsm discovers on its own.
 func (mf *MetadataFsm) HandleFatalEvent(err *raft.FatalError) {
-	panic(err.Err)
+	mf.fatal(0, "", mf.applied, err.Err)
 }
 
 // HandleLeaderChange implements the interface of raft.StateMachine
@@ -285,12 +449,17 @@ func (mf *MetadataFsm) HandleLeaderChange(leader uint64) {
 	}
 }
 
+// delKeyAndPutIndex deletes key and writes cmdMap (which carries the
+// "applied" cursor) through a single WriteBatch, so a crash between the
+// delete and the applied bump cannot leave them out of sync.
 func (mf *MetadataFsm) delKeyAndPutIndex(key string, cmdMap map[string][]byte) (err error) {
 	return mf.store.DeleteKeyAndPutIndex(key, cmdMap, true)
 }
 
-// Stop stops the RaftServer
+// Stop stops the RaftServer and marks this fsm as stopped, so importSafe
+// allows ImportSnapshot/MigrateBackend to run against it afterward.
 func (mf *MetadataFsm) Stop() {
+	atomic.StoreInt32(&mf.stopped, 1)
 	if mf.rs != nil {
 		mf.rs.Stop()
 	}
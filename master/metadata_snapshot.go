@@ -0,0 +1,131 @@
+// Copyright 2018 The CubeFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc64"
+	"io"
+)
+
+const (
+	// snapshotFormatVersion is sent as a single-byte record ahead of every
+	// other record, so old and new senders/receivers can detect a framing
+	// mismatch instead of failing deep inside a JSON unmarshal.
+	snapshotFormatVersion byte = 1
+
+	// opSnapshotTrailer is a sentinel op, well outside the range of the
+	// real opSyncXxx ops, marking the snapshot-level trailing checksum
+	// record. It never reaches MetadataFsm.Apply.
+	opSnapshotTrailer uint32 = 1<<32 - 1
+)
+
+var snapshotCRCTable = crc64.MakeTable(crc64.ECMA)
+
+// MetadataSnapshot implements the proto.Snapshot interface returned from
+// MetadataFsm.Snapshot. It walks every key under the backend's snapshot handle,
+// so the dump it produces is a consistent point-in-time view even while
+// raft keeps applying to the live store underneath it.
+type MetadataSnapshot struct {
+	fsm      *MetadataFsm
+	applied  uint64
+	snapshot FsmSnapshotHandle
+	iterator FsmIterator
+
+	versionSent bool
+	trailerSent bool
+	entryCount  uint64
+	runningCRC  uint64
+}
+
+// ApplyIndex implements the proto.Snapshot interface.
+func (s *MetadataSnapshot) ApplyIndex() uint64 {
+	return s.applied
+}
+
+// Close implements the proto.Snapshot interface.
+func (s *MetadataSnapshot) Close() {
+	s.snapshot.Close()
+}
+
+// Next implements the proto.Snapshot interface. The first call returns the
+// bare snapshotFormatVersion byte; each following call returns one
+// JSON-marshaled RaftCmd framed as [uint32 len][payload][uint64 crc64-ecma of
+// payload]; once the iterator is exhausted, one last call returns a trailer
+// record carrying the rolling CRC over every payload plus the entry count,
+// so the restore side can detect a truncated or corrupted stream before it
+// commits.
+func (s *MetadataSnapshot) Next() (data []byte, err error) {
+	if !s.versionSent {
+		s.versionSent = true
+		return []byte{snapshotFormatVersion}, nil
+	}
+	if s.iterator.Valid() {
+		cmd := &RaftCmd{Op: opSyncBatchPut, K: string(s.iterator.Key()), V: s.iterator.Value()}
+		payload, e := cmd.Marshal()
+		if e != nil {
+			return nil, e
+		}
+		s.runningCRC = crc64.Update(s.runningCRC, snapshotCRCTable, payload)
+		s.entryCount++
+		s.iterator.Next()
+		return encodeSnapshotFrame(payload), nil
+	}
+	if !s.trailerSent {
+		s.trailerSent = true
+		finalCRC := crc64.Update(s.runningCRC, snapshotCRCTable, uint64ToBytes(s.entryCount))
+		trailer := &RaftCmd{Op: opSnapshotTrailer, K: "cksum", V: uint64ToBytes(finalCRC)}
+		payload, e := trailer.Marshal()
+		if e != nil {
+			return nil, e
+		}
+		return encodeSnapshotFrame(payload), nil
+	}
+	return nil, io.EOF
+}
+
+func uint64ToBytes(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// encodeSnapshotFrame wraps payload as [uint32 len][payload][uint64 crc64].
+func encodeSnapshotFrame(payload []byte) []byte {
+	frame := make([]byte, 4+len(payload)+8)
+	binary.BigEndian.PutUint32(frame[:4], uint32(len(payload)))
+	copy(frame[4:4+len(payload)], payload)
+	binary.BigEndian.PutUint64(frame[4+len(payload):], crc64.Checksum(payload, snapshotCRCTable))
+	return frame
+}
+
+// decodeSnapshotFrame validates and strips the framing encodeSnapshotFrame
+// adds, returning the original payload.
+func decodeSnapshotFrame(frame []byte) (payload []byte, err error) {
+	if len(frame) < 12 {
+		return nil, fmt.Errorf("snapshot frame too short: %d bytes", len(frame))
+	}
+	n := binary.BigEndian.Uint32(frame[:4])
+	if uint32(len(frame)) != 4+n+8 {
+		return nil, fmt.Errorf("snapshot frame length mismatch: header says %d, frame is %d bytes", n, len(frame))
+	}
+	payload = frame[4 : 4+n]
+	wantCRC := binary.BigEndian.Uint64(frame[4+n:])
+	if gotCRC := crc64.Checksum(payload, snapshotCRCTable); gotCRC != wantCRC {
+		return nil, fmt.Errorf("snapshot frame crc mismatch: want %x got %x", wantCRC, gotCRC)
+	}
+	return payload, nil
+}
@@ -0,0 +1,264 @@
+// Copyright 2018 The CubeFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package master
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc64"
+	"io"
+	"net/http"
+
+	"github.com/cubefs/cubefs/util/log"
+	"github.com/cubefs/cubefs/util/stat"
+)
+
+// withAdminGate rejects w with 503 once the fsm has gone fatal, and
+// otherwise tracks the handler as in-flight so MetadataFsm.fatal can drain
+// it before the process goes down.
+func withAdminGate(w http.ResponseWriter) (release func(), ok bool) {
+	if err := fsmAdminGate.enter(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil, false
+	}
+	return fsmAdminGate.leave, true
+}
+
+// snapshotSchemaVersion guards against a future export format the current
+// binary doesn't understand yet.
+const snapshotSchemaVersion = 1
+
+// snapshotExportHeader is the first framed record written by ExportSnapshot
+// and read back by ImportSnapshot.
+type snapshotExportHeader struct {
+	ClusterID     string `json:"cluster_id"`
+	Applied       uint64 `json:"applied"`
+	SchemaVersion int    `json:"schema_version"`
+}
+
+// readSnapshotFrame reads one [uint32 len][payload][uint64 crc64] frame off
+// r and verifies it via decodeSnapshotFrame, the same framing/checksum
+// ApplySnapshot's restore path relies on.
+func readSnapshotFrame(r io.Reader) (payload []byte, err error) {
+	lenHeader := make([]byte, 4)
+	if _, err = io.ReadFull(r, lenHeader); err != nil {
+		return nil, err
+	}
+	rest := make([]byte, binary.BigEndian.Uint32(lenHeader)+8)
+	if _, err = io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+	return decodeSnapshotFrame(append(lenHeader, rest...))
+}
+
+// ExportSnapshot streams a consistent point-in-time copy of the metadata
+// store to w as a CRC-framed header record, one CRC-framed RaftCmd record
+// per key, and a trailing record carrying the running CRC64 over every
+// entry written -- the same encodeSnapshotFrame/opSnapshotTrailer scheme
+// ApplySnapshot uses, so a corrupted byte anywhere in transit or on disk is
+// caught by ImportSnapshot instead of silently becoming live master state.
+// Read through the backend's snapshot handle so it never blocks raft applies
+// landing on the live store. fromKey resumes a prior export that was cut
+// off partway through (empty means start from the beginning); the trailer
+// covers only the entries actually written by this call.
+func (mf *MetadataFsm) ExportSnapshot(w io.Writer, clusterID string, fromKey string) (err error) {
+	snapshot := mf.store.Snapshot()
+	defer snapshot.Close()
+	iterator := mf.store.Iterator(snapshot)
+
+	header := snapshotExportHeader{ClusterID: clusterID, Applied: mf.applied, SchemaVersion: snapshotSchemaVersion}
+	headerBytes, err := json.Marshal(header)
+	if err != nil {
+		return err
+	}
+	if _, err = w.Write(encodeSnapshotFrame(headerBytes)); err != nil {
+		return err
+	}
+
+	if fromKey == "" {
+		iterator.SeekToFirst()
+	} else {
+		iterator.Seek([]byte(fromKey))
+	}
+	var runningCRC uint64
+	var entryCount uint64
+	for ; iterator.Valid(); iterator.Next() {
+		cmd := &RaftCmd{Op: opSyncBatchPut, K: string(iterator.Key()), V: iterator.Value()}
+		payload, e := cmd.Marshal()
+		if e != nil {
+			return e
+		}
+		runningCRC = crc64.Update(runningCRC, snapshotCRCTable, payload)
+		entryCount++
+		if _, err = w.Write(encodeSnapshotFrame(payload)); err != nil {
+			return err
+		}
+	}
+
+	finalCRC := crc64.Update(runningCRC, snapshotCRCTable, uint64ToBytes(entryCount))
+	trailer := &RaftCmd{Op: opSnapshotTrailer, K: "cksum", V: uint64ToBytes(finalCRC)}
+	trailerPayload, err := trailer.Marshal()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(encodeSnapshotFrame(trailerPayload))
+	return err
+}
+
+// ImportSnapshot replays a stream produced by ExportSnapshot into a fresh
+// temp store using the same batched WriteBatch path ApplySnapshot uses,
+// verifies the trailing checksum before committing, then swaps the temp
+// store in with the same FsmBackend.AtomicSwap commit point. It is only safe to call on a
+// stopped or single-node master: it bypasses raft entirely, so running it
+// against a live multi-node cluster would desync replicas.
+func (mf *MetadataFsm) ImportSnapshot(r io.Reader) (err error) {
+	if !mf.importSafe() {
+		return fmt.Errorf("action[ImportSnapshot] refusing to import: master is neither stopped nor single-node")
+	}
+
+	headerBytes, err := readSnapshotFrame(r)
+	if err != nil {
+		return fmt.Errorf("action[ImportSnapshot] failed to read header: %v", err)
+	}
+	var header snapshotExportHeader
+	if err = json.Unmarshal(headerBytes, &header); err != nil {
+		return err
+	}
+	if header.SchemaVersion != snapshotSchemaVersion {
+		return fmt.Errorf("action[ImportSnapshot] unsupported snapshot schema version %v", header.SchemaVersion)
+	}
+
+	tempDb, err := mf.store.OpenTemp(fsmRecoveryDir(mf.store.GetDir()))
+	if err != nil {
+		return err
+	}
+
+	batch := tempDb.NewWriteBatch()
+	defer batch.Destroy()
+	var batchBytes uint64
+	var batchCount int
+	var runningCRC uint64
+	var entryCount uint64
+	var trailerSeen bool
+	for {
+		var payload []byte
+		if payload, err = readSnapshotFrame(r); err != nil {
+			break
+		}
+		cmd := &RaftCmd{}
+		if err = json.Unmarshal(payload, cmd); err != nil {
+			tempDb.Close()
+			return err
+		}
+		if cmd.Op == opSnapshotTrailer {
+			trailerSeen = true
+			wantCRC := binary.BigEndian.Uint64(cmd.V)
+			gotCRC := crc64.Update(runningCRC, snapshotCRCTable, uint64ToBytes(entryCount))
+			if gotCRC != wantCRC {
+				tempDb.Close()
+				return fmt.Errorf("action[ImportSnapshot] trailing checksum mismatch: want %x got %x", wantCRC, gotCRC)
+			}
+			continue
+		}
+
+		runningCRC = crc64.Update(runningCRC, snapshotCRCTable, payload)
+		entryCount++
+		batch.Put([]byte(cmd.K), cmd.V)
+		batchBytes += uint64(len(cmd.K) + len(cmd.V))
+		batchCount++
+		if batchBytes >= mf.snapshotRestoreBatchBytes || batchCount >= mf.snapshotRestoreBatchCount {
+			bgTime := stat.BeginStat()
+			if err = tempDb.WriteBatch(batch, false); err != nil {
+				tempDb.Close()
+				return err
+			}
+			stat.EndStat("ImportSnapshot-WriteBatch", nil, bgTime, 1)
+			stat.EndStat("ImportSnapshot-BatchesFlushed", nil, bgTime, 1)
+			stat.EndStat("ImportSnapshot-BytesWritten", nil, bgTime, int(batchBytes))
+			batch.Clear()
+			batchBytes, batchCount = 0, 0
+		}
+	}
+	if err != io.EOF {
+		tempDb.Close()
+		return err
+	}
+	if !trailerSeen {
+		tempDb.Close()
+		return fmt.Errorf("action[ImportSnapshot] stream ended before trailer record, %v entries seen", entryCount)
+	}
+	err = nil
+	if batchCount > 0 {
+		bgTime := stat.BeginStat()
+		if err = tempDb.WriteBatch(batch, false); err != nil {
+			tempDb.Close()
+			return err
+		}
+		stat.EndStat("ImportSnapshot-WriteBatch", nil, bgTime, 1)
+		stat.EndStat("ImportSnapshot-BatchesFlushed", nil, bgTime, 1)
+		stat.EndStat("ImportSnapshot-BytesWritten", nil, bgTime, int(batchBytes))
+	}
+	if err = tempDb.Flush(); err != nil {
+		tempDb.Close()
+		return err
+	}
+
+	// commit point: same AtomicSwap primitive ApplySnapshot uses.
+	if err = mf.store.AtomicSwap(tempDb); err != nil {
+		return err
+	}
+	mf.applied = header.Applied
+	log.LogWarnf("action[ImportSnapshot] success,applied[%v]", mf.applied)
+	return nil
+}
+
+// snapshotExportHandler implements GET /admin/snapshot/export. It streams
+// the response directly from ExportSnapshot, so callers with a large master
+// state don't need to buffer it. ?from-key= resumes an export that was cut
+// off by an HTTP disconnect partway through.
+func (m *Server) snapshotExportHandler(w http.ResponseWriter, r *http.Request) {
+	release, ok := withAdminGate(w)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if err := r.ParseForm(); err != nil {
+		sendErrReply(w, r, newErrHTTPReply(err))
+		return
+	}
+	fromKey := r.FormValue("from-key")
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if err := m.cluster.fsm.ExportSnapshot(w, m.cluster.Name, fromKey); err != nil {
+		log.LogErrorf("action[snapshotExportHandler] failed, err %v", err)
+	}
+}
+
+// snapshotImportHandler implements POST /admin/snapshot/import. See
+// MetadataFsm.ImportSnapshot for the restore and atomic-swap behavior.
+func (m *Server) snapshotImportHandler(w http.ResponseWriter, r *http.Request) {
+	release, ok := withAdminGate(w)
+	if !ok {
+		return
+	}
+	defer release()
+
+	if err := m.cluster.fsm.ImportSnapshot(r.Body); err != nil {
+		sendErrReply(w, r, newErrHTTPReply(err))
+		return
+	}
+	sendOkReply(w, r, newSuccessHTTPReply("snapshot import succeeded"))
+}
@@ -0,0 +1,192 @@
+// Copyright 2018 The CubeFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+// Package raftstore_bolt is a pure-Go BoltDB-backed implementation of the
+// same key/value operations raftstore_db.RocksDBStore provides, for
+// operators who want to run the master without a cgo/RocksDB dependency.
+package raftstore_bolt
+
+import (
+	"os"
+	"path/filepath"
+
+	"go.etcd.io/bbolt"
+)
+
+var dataBucket = []byte("fsm")
+
+const dbFileName = "fsm.bolt"
+
+// BoltDBStore is a single-file, pure-Go key/value store.
+type BoltDBStore struct {
+	dir string
+	db  *bbolt.DB
+}
+
+// NewBoltDBStore opens (creating if necessary) a bolt store rooted at dir.
+func NewBoltDBStore(dir string) (*BoltDBStore, error) {
+	s := &BoltDBStore{dir: dir}
+	if err := s.Open(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// DBPath returns the path of the single bolt file backing this store.
+func (s *BoltDBStore) DBPath() string {
+	return filepath.Join(s.dir, dbFileName)
+}
+
+// Open opens (or re-opens) the underlying bolt file.
+func (s *BoltDBStore) Open() error {
+	if err := os.MkdirAll(s.dir, 0o755); err != nil {
+		return err
+	}
+	db, err := bbolt.Open(s.DBPath(), 0o644, nil)
+	if err != nil {
+		return err
+	}
+	if err = db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(dataBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return err
+	}
+	s.db = db
+	return nil
+}
+
+// Close closes the underlying bolt file.
+func (s *BoltDBStore) Close() {
+	if s.db != nil {
+		s.db.Close()
+		s.db = nil
+	}
+}
+
+// GetDir returns the directory this store is rooted at.
+func (s *BoltDBStore) GetDir() string {
+	return s.dir
+}
+
+// Flush forces the bolt file to durable storage.
+func (s *BoltDBStore) Flush() error {
+	return s.db.Sync()
+}
+
+// Get returns the value for key, or a nil []byte if it doesn't exist.
+func (s *BoltDBStore) Get(key string) (interface{}, error) {
+	var value []byte
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		if v := tx.Bucket(dataBucket).Get([]byte(key)); v != nil {
+			value = append([]byte(nil), v...)
+		}
+		return nil
+	})
+	return value, err
+}
+
+// BatchPut writes every key/value in data inside a single transaction.
+func (s *BoltDBStore) BatchPut(data map[string][]byte, sync bool) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(dataBucket)
+		for k, v := range data {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteKeyAndPutIndex deletes key and writes cmdMap inside a single
+// transaction, mirroring RocksDBStore.DeleteKeyAndPutIndex.
+func (s *BoltDBStore) DeleteKeyAndPutIndex(key string, cmdMap map[string][]byte, sync bool) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(dataBucket)
+		if err := b.Delete([]byte(key)); err != nil {
+			return err
+		}
+		for k, v := range cmdMap {
+			if err := b.Put([]byte(k), v); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// Snapshot returns a long-lived read-only transaction. Bolt's MVCC means it
+// observes a consistent point-in-time view even while writers continue.
+func (s *BoltDBStore) Snapshot() (*Snapshot, error) {
+	tx, err := s.db.Begin(false)
+	if err != nil {
+		return nil, err
+	}
+	return &Snapshot{tx: tx}, nil
+}
+
+// Snapshot wraps a read-only bolt transaction.
+type Snapshot struct {
+	tx *bbolt.Tx
+}
+
+// Close releases the underlying read-only transaction.
+func (sn *Snapshot) Close() {
+	if sn.tx != nil {
+		sn.tx.Rollback()
+	}
+}
+
+// Iterator walks a Snapshot's bucket in key order via a bolt cursor.
+type Iterator struct {
+	cursor     *bbolt.Cursor
+	key, value []byte
+	valid      bool
+}
+
+// Iterator returns an Iterator positioned before the first key of sn.
+func (s *BoltDBStore) Iterator(sn *Snapshot) *Iterator {
+	if sn.tx == nil {
+		return &Iterator{}
+	}
+	return &Iterator{cursor: sn.tx.Bucket(dataBucket).Cursor()}
+}
+
+func (it *Iterator) SeekToFirst() {
+	if it.cursor == nil {
+		return
+	}
+	it.key, it.value = it.cursor.First()
+	it.valid = it.key != nil
+}
+
+func (it *Iterator) Seek(key []byte) {
+	if it.cursor == nil {
+		return
+	}
+	it.key, it.value = it.cursor.Seek(key)
+	it.valid = it.key != nil
+}
+
+func (it *Iterator) Valid() bool { return it.valid }
+
+func (it *Iterator) Next() {
+	it.key, it.value = it.cursor.Next()
+	it.valid = it.key != nil
+}
+
+func (it *Iterator) Key() []byte   { return it.key }
+func (it *Iterator) Value() []byte { return it.value }
@@ -0,0 +1,63 @@
+// Copyright 2018 The CubeFS Authors.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or
+// implied. See the License for the specific language governing
+// permissions and limitations under the License.
+
+package raftstore_bolt
+
+import "go.etcd.io/bbolt"
+
+type kv struct {
+	key, value []byte
+}
+
+// WriteBatch accumulates puts to apply inside a single bolt transaction.
+// Unlike RocksDB, bolt has no native batch type, so this just buffers the
+// operations and replays them when WriteBatch is called.
+type WriteBatch struct {
+	ops []kv
+}
+
+// NewWriteBatch returns an empty WriteBatch.
+func NewWriteBatch() *WriteBatch {
+	return &WriteBatch{}
+}
+
+func (wb *WriteBatch) Put(key, value []byte) {
+	wb.ops = append(wb.ops, kv{key: append([]byte(nil), key...), value: append([]byte(nil), value...)})
+}
+
+func (wb *WriteBatch) Clear() {
+	wb.ops = wb.ops[:0]
+}
+
+func (wb *WriteBatch) Destroy() {
+	wb.ops = nil
+}
+
+// NewWriteBatch returns an empty WriteBatch for this store.
+func (s *BoltDBStore) NewWriteBatch() *WriteBatch {
+	return NewWriteBatch()
+}
+
+// WriteBatch commits every buffered put in a single bolt transaction.
+func (s *BoltDBStore) WriteBatch(batch *WriteBatch, sync bool) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(dataBucket)
+		for _, op := range batch.ops {
+			if err := b.Put(op.key, op.value); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}